@@ -0,0 +1,25 @@
+package main
+
+import "crypto/subtle"
+
+// CredentialStore authenticates a (user, password) pair presented to the
+// /token endpoint and reports which actions the user may request tokens
+// for. It exists so obmd can eventually be backed by something other
+// than the single shared admin secret -- LDAP, OIDC, an HTTP callout --
+// without changing the token-issuing logic itself.
+type CredentialStore interface {
+	Authenticate(user, pass string) (actions []string, ok bool)
+}
+
+// noCredentialStore rejects every credential; it's the default for
+// deployments that only use the admin secret.
+type noCredentialStore struct{}
+
+func (noCredentialStore) Authenticate(user, pass string) ([]string, bool) {
+	return nil, false
+}
+
+// secureCompare does a constant-time comparison of two secrets.
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
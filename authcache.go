@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// AuthCache remembers that a credential was recently checked and found
+// valid, so repeated requests from the same caller don't have to re-run
+// a potentially expensive validator (today a constant-time compare;
+// eventually an LDAP/OIDC/HTTP callout). It's consulted before the
+// validator runs and populated only on success -- a miss always falls
+// through to the real check.
+type AuthCache interface {
+	// Get reports whether key has an unexpired, cached positive result.
+	Get(key string) bool
+	// Put records that key was just successfully validated.
+	Put(key string)
+	// Clear discards every cached entry, e.g. because a secret it was
+	// checked against has been rotated.
+	Clear()
+}
+
+// hashCredential derives an AuthCache key from a presented credential,
+// so the cache never holds the credential itself in memory.
+func hashCredential(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte{0}) // separator, so ("a","bc") != ("ab","c")
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// noopAuthCache never caches anything; every Get is a miss. It's the
+// right choice for tests, and for deployments that would rather always
+// hit the real validator than hold any state about recent callers.
+type noopAuthCache struct{}
+
+func (noopAuthCache) Get(key string) bool { return false }
+func (noopAuthCache) Put(key string)      {}
+func (noopAuthCache) Clear()              {}
+
+// lruAuthCache is a bounded, TTL-expiring in-memory AuthCache.
+type lruAuthCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	ll       *list.List               // front = most recently used
+	entries  map[string]*list.Element // value: *cacheEntry
+}
+
+type cacheEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// newLRUAuthCache builds an AuthCache holding at most capacity entries,
+// each valid for ttl after being cached. A capacity of 0 or less puts no
+// bound on the number of entries.
+func newLRUAuthCache(capacity int, ttl time.Duration) *lruAuthCache {
+	return &lruAuthCache{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *lruAuthCache) Get(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.removeLocked(elem)
+		return false
+	}
+	c.ll.MoveToFront(elem)
+	return true
+}
+
+func (c *lruAuthCache) Put(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).expiresAt = time.Now().Add(c.ttl)
+		c.ll.MoveToFront(elem)
+		return
+	}
+	elem := c.ll.PushFront(&cacheEntry{key: key, expiresAt: time.Now().Add(c.ttl)})
+	c.entries[key] = elem
+	for c.capacity > 0 && c.ll.Len() > c.capacity {
+		c.removeLocked(c.ll.Back())
+	}
+}
+
+func (c *lruAuthCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *lruAuthCache) removeLocked(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
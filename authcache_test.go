@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUAuthCacheHitAndMiss(t *testing.T) {
+	c := newLRUAuthCache(10, time.Minute)
+	if c.Get("k") {
+		t.Fatal("expected miss before Put")
+	}
+	c.Put("k")
+	if !c.Get("k") {
+		t.Fatal("expected hit after Put")
+	}
+}
+
+func TestLRUAuthCacheExpiry(t *testing.T) {
+	c := newLRUAuthCache(10, time.Millisecond)
+	c.Put("k")
+	time.Sleep(10 * time.Millisecond)
+	if c.Get("k") {
+		t.Fatal("expected entry to have expired")
+	}
+}
+
+func TestLRUAuthCacheEvictsOldest(t *testing.T) {
+	c := newLRUAuthCache(2, time.Minute)
+	c.Put("a")
+	c.Put("b")
+	c.Put("c") // should evict "a"
+	if c.Get("a") {
+		t.Fatal("expected \"a\" to have been evicted")
+	}
+	if !c.Get("b") || !c.Get("c") {
+		t.Fatal("expected \"b\" and \"c\" to still be cached")
+	}
+}
+
+func TestLRUAuthCacheClear(t *testing.T) {
+	c := newLRUAuthCache(10, time.Minute)
+	c.Put("k")
+	c.Clear()
+	if c.Get("k") {
+		t.Fatal("expected cache to be empty after Clear")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultRingSize is how much recent console output a consoleSession
+// keeps around to replay to newly-attached viewers, when the node's
+// Config doesn't specify its own size.
+const defaultRingSize = 64 * 1024
+
+// subscriberBacklog is how many not-yet-delivered writes a viewer may
+// have queued before it's considered too slow to keep up and is
+// disconnected.
+const subscriberBacklog = 256
+
+// consoleSession represents obmd's single long-lived connection to a
+// node's IPMI SOL console. It stays open for the lifetime of the node,
+// independent of whether anyone is attached to it, so that revoking a
+// viewer's token doesn't tear down (or restart) the underlying BMC
+// session. Any number of viewers may attach concurrently; each gets its
+// own independent io.ReadCloser, fed from a shared ring buffer so late
+// joiners see recent history before transitioning to live output.
+type consoleSession struct {
+	mu       sync.Mutex
+	gen      int64
+	subs     map[*consoleSubscriber]struct{}
+	ring     []byte
+	ringSize int
+	src      consoleSource
+	done     chan struct{}
+}
+
+// consoleSubscriber is one viewer's attachment to a consoleSession.
+type consoleSubscriber struct {
+	ch   chan []byte
+	w    *io.PipeWriter
+	once sync.Once
+}
+
+func (sub *consoleSubscriber) closeWith(err error) {
+	sub.once.Do(func() {
+		if err != nil {
+			sub.w.CloseWithError(err)
+		} else {
+			sub.w.Close()
+		}
+	})
+}
+
+// consoleResetter is an optional capability of a consoleSource: sources
+// that can tell when the underlying link was interrupted (e.g. a real
+// SOL session dropping a byte or two while the BMC tears it down)
+// implement it so consoleSession.revoke can account for the gap.
+type consoleResetter interface {
+	reset()
+}
+
+// consoleInputWriter is an optional capability of a consoleSource:
+// sources that accept keyboard input, such as a real interactive SOL
+// session, implement it.
+type consoleInputWriter interface {
+	WriteInput(p []byte) (int, error)
+}
+
+// writeInput forwards p to the underlying source as keyboard input, if
+// it supports receiving any.
+func (s *consoleSession) writeInput(p []byte) {
+	if w, ok := s.src.(consoleInputWriter); ok {
+		w.WriteInput(p)
+	}
+}
+
+// newConsoleSession starts driving src and returns a session that
+// viewers can attach to. ringSize bounds how much history is kept for
+// replay to new viewers; 0 selects defaultRingSize.
+func newConsoleSession(src consoleSource, ringSize int) *consoleSession {
+	if ringSize <= 0 {
+		ringSize = defaultRingSize
+	}
+	s := &consoleSession{
+		subs:     make(map[*consoleSubscriber]struct{}),
+		ringSize: ringSize,
+		src:      src,
+		done:     make(chan struct{}),
+	}
+	go s.run(src)
+	return s
+}
+
+func (s *consoleSession) run(src consoleSource) {
+	defer close(s.done)
+	src.Run(s.broadcast)
+}
+
+// broadcast appends line to the replay ring and fans it out to every
+// attached viewer. A viewer whose backlog is already full is too slow
+// to keep up and is disconnected rather than allowed to block the rest.
+//
+// The send to sub.ch happens while s.mu is still held, and
+// removeSubscriber deletes sub from s.subs under s.mu before it calls
+// close(sub.ch): that's what guarantees broadcast can never send on a
+// channel removeSubscriber has already closed or is about to close.
+func (s *consoleSession) broadcast(line string) {
+	data := []byte(line)
+
+	s.mu.Lock()
+	s.ring = append(s.ring, data...)
+	if len(s.ring) > s.ringSize {
+		s.ring = append([]byte(nil), s.ring[len(s.ring)-s.ringSize:]...)
+	}
+	var slow []*consoleSubscriber
+	for sub := range s.subs {
+		select {
+		case sub.ch <- data:
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sub := range slow {
+		s.removeSubscriber(sub, fmt.Errorf("client fell behind and was disconnected"))
+	}
+}
+
+// generation reports the session's current generation; tokens minted
+// against an earlier generation are no longer valid.
+func (s *consoleSession) generation() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen
+}
+
+// attach connects a new viewer to the session, provided gen matches the
+// session's current generation. The viewer first receives whatever
+// history is currently in the replay ring, then transitions to live
+// output with no gap or duplication.
+func (s *consoleSession) attach(gen int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	if gen != s.gen {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("console token has been revoked")
+	}
+	replay := make([]byte, len(s.ring))
+	copy(replay, s.ring)
+	r, w := io.Pipe()
+	sub := &consoleSubscriber{ch: make(chan []byte, subscriberBacklog), w: w}
+	s.subs[sub] = struct{}{}
+	s.mu.Unlock()
+
+	go s.pumpSubscriber(sub, replay)
+	return r, nil
+}
+
+// pumpSubscriber writes replay and then sub's live backlog to its pipe,
+// disconnecting it if the reader on the other end goes away.
+func (s *consoleSession) pumpSubscriber(sub *consoleSubscriber, replay []byte) {
+	if len(replay) > 0 {
+		if _, err := sub.w.Write(replay); err != nil {
+			s.removeSubscriber(sub, nil)
+			return
+		}
+	}
+	for data := range sub.ch {
+		if _, err := sub.w.Write(data); err != nil {
+			s.removeSubscriber(sub, nil)
+			return
+		}
+	}
+}
+
+// removeSubscriber detaches sub and closes its pipe with err (nil for a
+// clean disconnect, e.g. on revocation). It's safe to call more than
+// once for the same subscriber.
+func (s *consoleSession) removeSubscriber(sub *consoleSubscriber, err error) {
+	s.mu.Lock()
+	_, ok := s.subs[sub]
+	delete(s.subs, sub)
+	s.mu.Unlock()
+	if ok {
+		close(sub.ch)
+	}
+	sub.closeWith(err)
+}
+
+// revoke disconnects every attached viewer and bumps the generation,
+// invalidating every token minted so far.
+func (s *consoleSession) revoke() {
+	s.mu.Lock()
+	s.gen++
+	// Each revocation starts a fresh epoch: viewers granted a token
+	// against the new generation shouldn't be handed history that was
+	// visible under a token we just invalidated.
+	s.ring = nil
+	subs := make([]*consoleSubscriber, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		s.removeSubscriber(sub, nil)
+	}
+	if resetter, ok := s.src.(consoleResetter); ok {
+		resetter.reset()
+	}
+}
+
+// close disconnects every attached viewer, e.g. because the node itself
+// was deleted.
+func (s *consoleSession) close() {
+	s.mu.Lock()
+	subs := make([]*consoleSubscriber, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		s.removeSubscriber(sub, nil)
+	}
+}
+
+// consoleSource produces console output. Run calls emit once per line of
+// output and blocks until the underlying source is closed.
+type consoleSource interface {
+	Run(emit func(line string))
+}
+
+// fakeConsoleSource is a stand-in for a real IPMI SOL session: it emits
+// a monotonically increasing counter, one line per tick, so tests can
+// make assertions about ordering and continuity without a real BMC. It
+// implements consoleResetter so that, like a real SOL link, a reset
+// (token revocation) loses a line rather than picking up exactly where
+// the last viewer left off.
+type fakeConsoleSource struct {
+	mu      sync.Mutex
+	tick    time.Duration
+	counter int
+}
+
+func (f *fakeConsoleSource) Run(emit func(line string)) {
+	tick := f.tick
+	if tick == 0 {
+		tick = 50 * time.Millisecond
+	}
+	for {
+		f.mu.Lock()
+		v := f.counter
+		f.counter++
+		f.mu.Unlock()
+		emit(fmt.Sprintf("%d\n", v))
+		time.Sleep(tick)
+	}
+}
+
+func (f *fakeConsoleSource) reset() {
+	f.mu.Lock()
+	f.counter++
+	f.mu.Unlock()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// newConsoleSource builds the consoleSource that drives a node's console
+// session, based on its registered type. It's a variable so tests can
+// swap in a fake source instead of shelling out to ipmitool.
+var newConsoleSource = func(info NodeInfo) (consoleSource, error) {
+	switch info.Type {
+	case "ipmi":
+		return &ipmiSOLSource{info: info.Info}, nil
+	default:
+		return nil, fmt.Errorf("unsupported node type: %q", info.Type)
+	}
+}
+
+// ipmiSOLSource drives a real IPMI serial-over-LAN session via ipmitool.
+// It implements consoleInputWriter, forwarding WriteInput to the
+// session's stdin so a console viewer's keystrokes reach the node.
+type ipmiSOLSource struct {
+	info IPMIInfo
+
+	mu    sync.Mutex
+	stdin io.WriteCloser
+}
+
+func (s *ipmiSOLSource) Run(emit func(line string)) {
+	cmd := exec.Command("ipmitool",
+		"-I", "lanplus",
+		"-H", s.info.Addr,
+		"-U", s.info.User,
+		"-P", s.info.Pass,
+		"sol", "activate",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.stdin = stdin
+	s.mu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		emit(scanner.Text() + "\n")
+	}
+	cmd.Wait()
+}
+
+func (s *ipmiSOLSource) WriteInput(p []byte) (int, error) {
+	s.mu.Lock()
+	stdin := s.stdin
+	s.mu.Unlock()
+	if stdin == nil {
+		return 0, fmt.Errorf("console session is not yet connected")
+	}
+	return stdin.Write(p)
+}
+
+// newPowerController builds the powerController that drives a node's
+// power actions and sensor reads, based on its registered type. Like
+// newConsoleSource, it's a variable so tests can swap in a fake instead
+// of shelling out to ipmitool.
+var newPowerController = func(info NodeInfo) (powerController, error) {
+	switch info.Type {
+	case "ipmi":
+		return &ipmiPowerController{info: info.Info}, nil
+	default:
+		return nil, fmt.Errorf("unsupported node type: %q", info.Type)
+	}
+}
+
+// ipmiPowerController drives chassis power control and sensor reads
+// over IPMI via ipmitool, the same CLI the console path shells out to
+// for SOL.
+type ipmiPowerController struct {
+	info IPMIInfo
+}
+
+func (c *ipmiPowerController) PowerAction(action string) error {
+	if !validPowerActions[action] {
+		return fmt.Errorf("unsupported power action: %q", action)
+	}
+	_, err := c.run("chassis", "power", action)
+	return err
+}
+
+func (c *ipmiPowerController) PowerStatus() (string, error) {
+	out, err := c.run("chassis", "power", "status")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func (c *ipmiPowerController) Sensors() ([]SensorReading, error) {
+	out, err := c.run("sensor")
+	if err != nil {
+		return nil, err
+	}
+	return parseSensorOutput(out), nil
+}
+
+func (c *ipmiPowerController) run(args ...string) (string, error) {
+	cmdArgs := append([]string{
+		"-I", "lanplus",
+		"-H", c.info.Addr,
+		"-U", c.info.User,
+		"-P", c.info.Pass,
+	}, args...)
+	out, err := exec.Command("ipmitool", cmdArgs...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ipmitool %s: %w", strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
+
+// parseSensorOutput parses the pipe-delimited output of `ipmitool
+// sensor`, e.g. "CPU Temp | 40.000 | degrees C | ok | ...".
+func parseSensorOutput(out string) []SensorReading {
+	var readings []SensorReading
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "|")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(fields) < 4 || fields[0] == "" {
+			continue
+		}
+		readings = append(readings, SensorReading{
+			Name:   fields[0],
+			Value:  fields[1],
+			Units:  fields[2],
+			Status: fields[3],
+		})
+	}
+	return readings
+}
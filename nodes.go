@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// IPMIInfo holds the connection details obmd needs in order to drive a
+// node's BMC over IPMI.
+type IPMIInfo struct {
+	Addr string `json:"addr"`
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// NodeInfo is the JSON representation of a node, as accepted by
+// PUT /node/<name>.
+type NodeInfo struct {
+	Type string   `json:"type"`
+	Info IPMIInfo `json:"info"`
+}
+
+// nodeStore tracks the set of nodes obmd currently knows about, plus
+// whatever console state each of them has outstanding.
+type nodeStore struct {
+	mu    sync.Mutex
+	nodes map[string]*node
+}
+
+// node is the server's internal record for a single managed machine.
+// consoleMu guards console itself: nodeStore.mu only protects the node
+// map, and is released well before a handler gets around to lazily
+// creating the console session, so two concurrent requests for the
+// same not-yet-initialized node need their own lock to avoid racing on
+// the field.
+type node struct {
+	info NodeInfo
+
+	consoleMu sync.Mutex
+	console   *consoleSession
+}
+
+// getConsole returns n's console session, or nil if one hasn't been
+// created yet.
+func (n *node) getConsole() *consoleSession {
+	n.consoleMu.Lock()
+	defer n.consoleMu.Unlock()
+	return n.console
+}
+
+// ensureConsole returns n's console session, calling new to lazily
+// create it if this is the first request for one. Concurrent callers
+// racing to initialize the same node's console are serialized here, so
+// new runs at most once and they all observe the same session.
+func (n *node) ensureConsole(new func() (*consoleSession, error)) (*consoleSession, error) {
+	n.consoleMu.Lock()
+	defer n.consoleMu.Unlock()
+	if n.console == nil {
+		c, err := new()
+		if err != nil {
+			return nil, err
+		}
+		n.console = c
+	}
+	return n.console, nil
+}
+
+// closeConsole closes n's console session, if one exists.
+func (n *node) closeConsole() {
+	n.consoleMu.Lock()
+	c := n.console
+	n.consoleMu.Unlock()
+	if c != nil {
+		c.close()
+	}
+}
+
+// revokeConsole revokes n's console session, if one exists.
+func (n *node) revokeConsole() {
+	n.consoleMu.Lock()
+	c := n.console
+	n.consoleMu.Unlock()
+	if c != nil {
+		c.revoke()
+	}
+}
+
+func newNodeStore() *nodeStore {
+	return &nodeStore{nodes: make(map[string]*node)}
+}
+
+func (s *nodeStore) put(name string, info NodeInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes[name] = &node{info: info}
+}
+
+func (s *nodeStore) delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[name]
+	if !ok {
+		return fmt.Errorf("no such node: %q", name)
+	}
+	n.closeConsole()
+	delete(s.nodes, name)
+	return nil
+}
+
+func (s *nodeStore) get(name string) (*node, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[name]
+	return n, ok
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SensorReading is one row of parsed `ipmitool sensor` output.
+type SensorReading struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Units  string `json:"units"`
+	Status string `json:"status"`
+}
+
+// powerController drives power actions and sensor reads for a node, via
+// whatever out-of-band management channel it exposes.
+type powerController interface {
+	PowerAction(action string) error
+	PowerStatus() (string, error)
+	Sensors() ([]SensorReading, error)
+}
+
+// validPowerActions are the power actions accepted by POST
+// /node/<name>/power.
+var validPowerActions = map[string]bool{
+	"on":    true,
+	"off":   true,
+	"cycle": true,
+	"reset": true,
+	"soft":  true,
+}
+
+// fakePowerController is a stand-in for a real BMC power/sensor
+// channel, so tests can exercise the power and sensors endpoints
+// without shelling out to ipmitool.
+type fakePowerController struct {
+	mu     sync.Mutex
+	status string
+}
+
+func (f *fakePowerController) PowerAction(action string) error {
+	if !validPowerActions[action] {
+		return fmt.Errorf("unsupported power action: %q", action)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if action == "off" {
+		f.status = "off"
+	} else {
+		f.status = "on"
+	}
+	return nil
+}
+
+func (f *fakePowerController) PowerStatus() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status == "" {
+		return "on", nil
+	}
+	return f.status, nil
+}
+
+func (f *fakePowerController) Sensors() ([]SensorReading, error) {
+	return []SensorReading{
+		{Name: "CPU Temp", Value: "40.000", Units: "degrees C", Status: "ok"},
+		{Name: "PSU1 Status", Value: "0x01", Units: "discrete", Status: "ok"},
+	}, nil
+}
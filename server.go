@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds everything newHandlerConfig needs to build obmd's HTTP
+// handler: where to issue tokens from, how to sign them, and how to
+// authenticate callers.
+type Config struct {
+	BaseURL     string
+	Service     string
+	AdminSecret string
+	SigningKey  []byte
+	Creds       CredentialStore
+	TokenTTL    time.Duration
+
+	// ConsoleRingSize bounds how many bytes of console history a newly
+	// attached viewer is replayed, per node. 0 selects defaultRingSize.
+	ConsoleRingSize int
+
+	// AuthCache remembers recently-validated credentials so the admin
+	// secret doesn't have to be re-checked on every request. Defaults
+	// to noopAuthCache if nil.
+	AuthCache AuthCache
+}
+
+const defaultAdminSecret = "admin-secret"
+
+// defaultConfig returns the configuration newHandler() builds its
+// handler from. It's self-contained (a fixed admin secret and signing
+// key) so the test suite doesn't need to stand up real secrets.
+func defaultConfig() Config {
+	return Config{
+		BaseURL:     "http://localhost:8080",
+		Service:     "obmd",
+		AdminSecret: defaultAdminSecret,
+		SigningKey:  []byte("default-test-signing-key"),
+		Creds:       noCredentialStore{},
+		TokenTTL:    5 * time.Minute,
+		AuthCache:   noopAuthCache{},
+	}
+}
+
+// handler is obmd's top-level http.Handler. It routes admin, token and
+// console requests, and enforces that every request carries a bearer
+// token (or the admin secret) authorizing the action it's trying to
+// take.
+type handler struct {
+	cfg   Config
+	nodes *nodeStore
+
+	secretMu    sync.RWMutex
+	adminSecret string
+}
+
+// newHandler builds a handler with a self-contained default
+// configuration.
+func newHandler() http.Handler {
+	return newHandlerConfig(defaultConfig())
+}
+
+// newHandlerConfig builds a handler from an explicit Config, letting
+// callers -- real deployments, or tests that need a fixed signing key --
+// control how obmd authenticates callers and signs tokens.
+func newHandlerConfig(cfg Config) http.Handler {
+	if cfg.AuthCache == nil {
+		cfg.AuthCache = noopAuthCache{}
+	}
+	return &handler{cfg: cfg, nodes: newNodeStore(), adminSecret: cfg.AdminSecret}
+}
+
+// RotateAdminSecret replaces the admin secret and clears the auth
+// cache, since any cached positive result was validated against the
+// secret being replaced.
+func (h *handler) RotateAdminSecret(secret string) {
+	h.secretMu.Lock()
+	h.adminSecret = secret
+	h.secretMu.Unlock()
+	h.cfg.AuthCache.Clear()
+}
+
+func (h *handler) getAdminSecret() string {
+	h.secretMu.RLock()
+	defer h.secretMu.RUnlock()
+	return h.adminSecret
+}
+
+// checkAdminSecret reports whether pass is the configured admin secret,
+// consulting the auth cache before falling back to the constant-time
+// compare.
+func (h *handler) checkAdminSecret(pass string) bool {
+	key := hashCredential("admin", pass)
+	if h.cfg.AuthCache.Get(key) {
+		return true
+	}
+	if secureCompare(pass, h.getAdminSecret()) {
+		h.cfg.AuthCache.Put(key)
+		return true
+	}
+	return false
+}
+
+// route describes the operation and authorization requirements for a
+// single incoming request.
+type route struct {
+	op       string // "putNode", "deleteNode", "consoleEndpoints", "deleteToken", "console", "consoleWS", "setPower", "getPower", "sensors"
+	nodeName string
+	action   string
+}
+
+// routeFor maps a request's method and path onto a route, or reports ok
+// = false if nothing matches.
+func routeFor(method, path string) (route, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "node" || parts[1] == "" {
+		return route{}, false
+	}
+	name := parts[1]
+	switch {
+	case len(parts) == 2 && method == http.MethodPut:
+		return route{op: "putNode", nodeName: name, action: "admin"}, true
+	case len(parts) == 2 && method == http.MethodDelete:
+		return route{op: "deleteNode", nodeName: name, action: "admin"}, true
+	case len(parts) == 3 && parts[2] == "console-endpoints" && method == http.MethodPost:
+		return route{op: "consoleEndpoints", nodeName: name, action: "admin"}, true
+	case len(parts) == 3 && parts[2] == "token" && method == http.MethodDelete:
+		return route{op: "deleteToken", nodeName: name, action: "admin"}, true
+	case len(parts) == 3 && parts[2] == "console" && method == http.MethodGet:
+		return route{op: "console", nodeName: name, action: "console"}, true
+	case len(parts) == 4 && parts[2] == "console" && parts[3] == "ws" && method == http.MethodGet:
+		return route{op: "consoleWS", nodeName: name, action: "console"}, true
+	case len(parts) == 3 && parts[2] == "power" && method == http.MethodPost:
+		return route{op: "setPower", nodeName: name, action: "power"}, true
+	case len(parts) == 3 && parts[2] == "power" && method == http.MethodGet:
+		return route{op: "getPower", nodeName: name, action: "power"}, true
+	case len(parts) == 3 && parts[2] == "sensors" && method == http.MethodGet:
+		return route{op: "sensors", nodeName: name, action: "sensors"}, true
+	default:
+		return route{}, false
+	}
+}
+
+// authResult is the outcome of successfully authenticating a request:
+// either the caller presented the admin secret (and so may do
+// anything), or a bearer token scoped to particular node actions.
+type authResult struct {
+	isAdmin bool
+	claims  tokenClaims
+}
+
+func (a authResult) allows(nodeName, action string) bool {
+	if a.isAdmin {
+		return true
+	}
+	return a.claims.allows(nodeName, action)
+}
+
+// authenticate extracts and verifies whatever credentials r carries: the
+// admin secret via HTTP Basic auth, or a bearer token via the
+// Authorization header or (for console streaming clients that can't set
+// headers) a "token" query parameter.
+func (h *handler) authenticate(r *http.Request) (authResult, bool) {
+	if user, pass, ok := r.BasicAuth(); ok {
+		_ = user
+		if h.checkAdminSecret(pass) {
+			return authResult{isAdmin: true}, true
+		}
+		return authResult{}, false
+	}
+	tok := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		tok = strings.TrimPrefix(auth, "Bearer ")
+	} else if q := r.URL.Query().Get("token"); q != "" {
+		tok = q
+	}
+	if tok == "" {
+		return authResult{}, false
+	}
+	claims, err := parseToken(tok, h.cfg.SigningKey)
+	if err != nil {
+		return authResult{}, false
+	}
+	return authResult{claims: claims}, true
+}
+
+// challenge responds 401 with a WWW-Authenticate header describing the
+// scope the caller is missing, for a request that presented no usable
+// credentials at all.
+func (h *handler) challenge(w http.ResponseWriter, nodeName, action string) {
+	sc := scope{resourceType: "node", resourceName: nodeName, actions: []string{action}}
+	w.Header().Set("WWW-Authenticate", wwwAuthenticate(h.cfg.BaseURL+"/token", h.cfg.Service, []scope{sc}))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// forbidden responds 403 for a request that authenticated successfully
+// but whose token's scope doesn't cover the action the route requires.
+func (h *handler) forbidden(w http.ResponseWriter, nodeName, action string) {
+	sc := scope{resourceType: "node", resourceName: nodeName, actions: []string{action}}
+	w.Header().Set("WWW-Authenticate", wwwAuthenticate(h.cfg.BaseURL+"/token", h.cfg.Service, []scope{sc})+`,error="insufficient_scope"`)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		h.serveToken(w, r)
+		return
+	}
+	rt, ok := routeFor(r.Method, r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	auth, ok := h.authenticate(r)
+	if !ok {
+		h.challenge(w, rt.nodeName, rt.action)
+		return
+	}
+	if !auth.allows(rt.nodeName, rt.action) {
+		h.forbidden(w, rt.nodeName, rt.action)
+		return
+	}
+	switch rt.op {
+	case "putNode":
+		h.putNode(w, r, rt.nodeName)
+	case "deleteNode":
+		h.deleteNode(w, r, rt.nodeName)
+	case "consoleEndpoints":
+		h.consoleEndpoints(w, r, rt.nodeName)
+	case "deleteToken":
+		h.deleteToken(w, r, rt.nodeName)
+	case "console":
+		h.console(w, r, rt.nodeName)
+	case "consoleWS":
+		h.consoleWS(w, r, rt.nodeName)
+	case "setPower":
+		h.setPower(w, r, rt.nodeName)
+	case "getPower":
+		h.getPower(w, r, rt.nodeName)
+	case "sensors":
+		h.sensors(w, r, rt.nodeName)
+	}
+}
+
+func (h *handler) putNode(w http.ResponseWriter, r *http.Request, name string) {
+	var info NodeInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.nodes.put(name, info)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) deleteNode(w http.ResponseWriter, r *http.Request, name string) {
+	if err := h.nodes.delete(name); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// mintConsoleToken issues a fresh console-scoped token for n, reflecting
+// its current console generation.
+func (h *handler) mintConsoleToken(n *node, nodeName string) (Token, error) {
+	console, err := n.ensureConsole(func() (*consoleSession, error) {
+		src, err := newConsoleSource(n.info)
+		if err != nil {
+			return nil, err
+		}
+		return newConsoleSession(src, h.cfg.ConsoleRingSize), nil
+	})
+	if err != nil {
+		return Token{}, err
+	}
+	claims := tokenClaims{
+		Iss:    h.cfg.BaseURL,
+		Aud:    h.cfg.Service,
+		Exp:    time.Now().Add(h.cfg.TokenTTL).Unix(),
+		Access: []resourceAccess{{Type: "node", Name: nodeName, Actions: []string{"console"}}},
+		Gen:    map[string]int64{nodeName: console.generation()},
+	}
+	return signToken(h.cfg.SigningKey, claims)
+}
+
+func (h *handler) consoleEndpoints(w http.ResponseWriter, r *http.Request, name string) {
+	n, ok := h.nodes.get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	tok, err := h.mintConsoleToken(n, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpURL, wsURL, err := h.consoleURLs(name, tok)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenResp{
+		Token:        tok,
+		ConsoleURL:   httpURL,
+		ConsoleWSURL: wsURL,
+	})
+}
+
+// consoleURLs builds the HTTP and WebSocket URLs a client can use tok to
+// attach to nodeName's console.
+func (h *handler) consoleURLs(nodeName string, tok Token) (httpURL, wsURL string, err error) {
+	text, err := tok.MarshalText()
+	if err != nil {
+		return "", "", err
+	}
+	query := "?token=" + string(text)
+	httpURL = h.cfg.BaseURL + "/node/" + nodeName + "/console" + query
+	wsURL = strings.Replace(h.cfg.BaseURL, "http", "ws", 1) + "/node/" + nodeName + "/console/ws" + query
+	return httpURL, wsURL, nil
+}
+
+func (h *handler) deleteToken(w http.ResponseWriter, r *http.Request, name string) {
+	n, ok := h.nodes.get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	n.revokeConsole()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) console(w http.ResponseWriter, r *http.Request, name string) {
+	n, ok := h.nodes.get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	console := n.getConsole()
+	if console == nil {
+		http.NotFound(w, r)
+		return
+	}
+	auth, _ := h.authenticate(r)
+	gen := auth.claims.Gen[name]
+	rc, err := console.attach(gen)
+	if err != nil {
+		h.challenge(w, name, "console")
+		return
+	}
+	defer rc.Close()
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 4096)
+	for {
+		n, err := rc.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// consoleWS is the WebSocket counterpart to console: it carries the
+// same output in binary frames, and additionally accepts binary frames
+// from the client as keyboard input to the session. Token revocation
+// is surfaced as a close frame rather than a plain connection drop.
+func (h *handler) consoleWS(w http.ResponseWriter, r *http.Request, name string) {
+	n, ok := h.nodes.get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	console := n.getConsole()
+	if console == nil {
+		http.NotFound(w, r)
+		return
+	}
+	auth, _ := h.authenticate(r)
+	gen := auth.claims.Gen[name]
+	rc, err := console.attach(gen)
+	if err != nil {
+		h.challenge(w, name, "console")
+		return
+	}
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		rc.Close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer rc.Close()
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			nRead, readErr := rc.Read(buf)
+			if nRead > 0 {
+				if conn.WriteBinary(buf[:nRead]) != nil {
+					return
+				}
+			}
+			if readErr != nil {
+				if readErr == io.EOF {
+					conn.Close(wsCodeTokenRevoked, "token revoked")
+				} else {
+					conn.Close(wsCodeInternalError, readErr.Error())
+				}
+				return
+			}
+		}
+	}()
+
+	for {
+		data, err := conn.ReadBinary()
+		if err != nil {
+			return
+		}
+		console.writeInput(data)
+	}
+}
+
+// powerRequest is the JSON body of POST /node/<name>/power.
+type powerRequest struct {
+	Action string `json:"action"`
+}
+
+// powerResponse is the JSON body returned by GET /node/<name>/power.
+type powerResponse struct {
+	Status string `json:"status"`
+}
+
+func (h *handler) setPower(w http.ResponseWriter, r *http.Request, name string) {
+	n, ok := h.nodes.get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var body powerRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctrl, err := newPowerController(n.info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := ctrl.PowerAction(body.Action); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) getPower(w http.ResponseWriter, r *http.Request, name string) {
+	n, ok := h.nodes.get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ctrl, err := newPowerController(n.info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status, err := ctrl.PowerStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(powerResponse{Status: status})
+}
+
+func (h *handler) sensors(w http.ResponseWriter, r *http.Request, name string) {
+	n, ok := h.nodes.get(name)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ctrl, err := newPowerController(n.info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	readings, err := ctrl.Sensors()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readings)
+}
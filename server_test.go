@@ -13,6 +13,22 @@ import (
 	"time"
 )
 
+// doAdmin issues method/path against srv with the admin credentials,
+// failing the test if the request itself can't be sent.
+func doAdmin(t *testing.T, srv *httptest.Server, method, path, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("building %s %s: %v", method, path, err)
+	}
+	req.SetBasicAuth("", defaultAdminSecret)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp
+}
+
 // adminRequests is a sequence of admin-only requests that is used by various tests.
 var adminRequests = []requestSpec{
 	{"PUT", "http://localhost:8080/node/somenode", `{
@@ -24,12 +40,15 @@ var adminRequests = []requestSpec{
 		}
 	}`},
 	{"POST", "http://localhost:8080/node/somenode/console-endpoints", ""},
+	{"POST", "http://localhost:8080/node/somenode/power", `{"action": "cycle"}`},
+	{"GET", "http://localhost:8080/node/somenode/power", ""},
+	{"GET", "http://localhost:8080/node/somenode/sensors", ""},
 	{"DELETE", "http://localhost:8080/node/somenode", ""},
 	{"DELETE", "http://localhost:8080/node/somenode/token", ""},
 }
 
-// Verify: all admin-only requests should return 404 when made without
-// authentication.
+// Verify: all admin-only requests should challenge for a bearer token
+// when made without authentication.
 func TestAdminNoAuth(t *testing.T) {
 	handler := newHandler()
 
@@ -37,10 +56,57 @@ func TestAdminNoAuth(t *testing.T) {
 		req := v.toNoAuth()
 		resp := httptest.NewRecorder()
 		handler.ServeHTTP(resp, req)
-		if resp.Result().StatusCode != 404 {
+		result := resp.Result()
+		if result.StatusCode != http.StatusUnauthorized {
 			t.Fatalf("Un-authenticated adminRequests[%d] (%v) should have "+
-				"returned 404, but did not.", i, v)
+				"returned 401, but got %d.", i, v, result.StatusCode)
+		}
+		challenge := result.Header.Get("WWW-Authenticate")
+		scheme, params, err := parseAuthHeader(challenge)
+		if err != nil {
+			t.Fatalf("adminRequests[%d]: invalid WWW-Authenticate header %q: %v", i, challenge, err)
+		}
+		if scheme != "Bearer" {
+			t.Fatalf("adminRequests[%d]: expected Bearer challenge, got %q", i, scheme)
 		}
+		if params["scope"] == "" {
+			t.Fatalf("adminRequests[%d]: WWW-Authenticate header %q is missing a scope", i, challenge)
+		}
+	}
+}
+
+// Verify: the /token endpoint mints a bearer token granting the
+// requested, admin-authorized scope, and that token then satisfies the
+// matching admin request.
+func TestTokenEndpoint(t *testing.T) {
+	handler := newHandler()
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/token?service=obmd&scope=node:somenode:admin", nil)
+	req.SetBasicAuth("", defaultAdminSecret)
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	result := resp.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("token request failed with status %d", result.StatusCode)
+	}
+	var body TokenResp
+	if err := json.NewDecoder(result.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding token response: %v", err)
+	}
+	textTok, err := body.Token.MarshalText()
+	if err != nil {
+		t.Fatalf("marshaling token: %v", err)
+	}
+
+	req = httptest.NewRequest("PUT", "http://localhost:8080/node/somenode", bytes.NewBufferString(`{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.3", "user": "ipmiuser", "pass": "secret"}
+	}`))
+	req.Header.Set("Authorization", "Bearer "+string(textTok))
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if status := resp.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("bearer-authenticated PUT failed with status %d", status)
 	}
 }
 
@@ -48,7 +114,7 @@ func TestAdminNoAuth(t *testing.T) {
 func TestAdminGoodAuth(t *testing.T) {
 	handler := newHandler()
 
-	expected := []int{200, 200, 200, 404}
+	expected := []int{200, 200, 200, 200, 200, 200, 404}
 
 	for i, v := range adminRequests {
 		req := v.toAdminAuth()
@@ -62,6 +128,109 @@ func TestAdminGoodAuth(t *testing.T) {
 	}
 }
 
+// Verify that a token scoped only to "console" is rejected with 403,
+// not merely a generic 401, when presented against the power and
+// sensors endpoints -- it authenticated fine, it just isn't allowed to
+// do this.
+func TestConsoleScopeForbiddenFromPower(t *testing.T) {
+	handler := newHandler()
+
+	req := (&requestSpec{"PUT", "http://localhost/node/somenode", `{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.3", "user": "ipmiuser", "pass": "secret"}
+	}`}).toAdminAuth()
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if status := resp.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("TestConsoleScopeForbiddenFromPower: setup request failed with status %d", status)
+	}
+
+	token := getConsoleToken(t, handler, "somenode")
+
+	for _, v := range []requestSpec{
+		{"POST", "http://localhost/node/somenode/power?token=" + token, `{"action": "cycle"}`},
+		{"GET", "http://localhost/node/somenode/power?token=" + token, ""},
+		{"GET", "http://localhost/node/somenode/sensors?token=" + token, ""},
+	} {
+		req := v.toNoAuth()
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		if status := resp.Result().StatusCode; status != http.StatusForbidden {
+			t.Fatalf("TestConsoleScopeForbiddenFromPower: %s %s: wanted 403 but got %d",
+				v.method, v.url, status)
+		}
+	}
+}
+
+// Verify that a second identical admin request hits the configured
+// AuthCache instead of re-running the (constant-time) secret compare.
+func TestAdminAuthCacheBypassesValidator(t *testing.T) {
+	srv := newHandlerConfig(Config{
+		AdminSecret: "s3cr3t",
+		SigningKey:  []byte("k"),
+		Creds:       noCredentialStore{},
+		TokenTTL:    time.Minute,
+		AuthCache:   newLRUAuthCache(10, time.Minute),
+	})
+	h := srv.(*handler)
+
+	req := (&requestSpec{"PUT", "http://localhost/node/somenode", `{"type":"ipmi","info":{"addr":"10.0.0.3","user":"u","pass":"p"}}`}).toNoAuth()
+	req.SetBasicAuth("", "s3cr3t")
+	resp := httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+	if status := resp.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("setup request failed with status %d", status)
+	}
+
+	// Change the secret directly, bypassing RotateAdminSecret, so the
+	// cache is left populated with what's now a "stale" result. A
+	// second request presenting the old secret should still succeed,
+	// because it's served from the cache instead of re-running the
+	// compare against the new secret.
+	h.secretMu.Lock()
+	h.adminSecret = "different-secret"
+	h.secretMu.Unlock()
+
+	req = (&requestSpec{"DELETE", "http://localhost/node/somenode", ""}).toNoAuth()
+	req.SetBasicAuth("", "s3cr3t")
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+	if status := resp.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("expected cached credential to bypass the validator, got status %d", status)
+	}
+}
+
+// Verify that rotating the admin secret clears the auth cache, so a
+// previously-cached credential stops working immediately.
+func TestAdminAuthCacheEvictedOnRotation(t *testing.T) {
+	srv := newHandlerConfig(Config{
+		AdminSecret: "s3cr3t",
+		SigningKey:  []byte("k"),
+		Creds:       noCredentialStore{},
+		TokenTTL:    time.Minute,
+		AuthCache:   newLRUAuthCache(10, time.Minute),
+	})
+	h := srv.(*handler)
+
+	req := (&requestSpec{"PUT", "http://localhost/node/somenode", `{"type":"ipmi","info":{"addr":"10.0.0.3","user":"u","pass":"p"}}`}).toNoAuth()
+	req.SetBasicAuth("", "s3cr3t")
+	resp := httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+	if status := resp.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("setup request failed with status %d", status)
+	}
+
+	h.RotateAdminSecret("different-secret")
+
+	req = (&requestSpec{"DELETE", "http://localhost/node/somenode", ""}).toNoAuth()
+	req.SetBasicAuth("", "s3cr3t")
+	resp = httptest.NewRecorder()
+	srv.ServeHTTP(resp, req)
+	if status := resp.Result().StatusCode; status != http.StatusUnauthorized {
+		t.Fatalf("expected rotated secret to evict the cache and reject the old credential, got status %d", status)
+	}
+}
+
 // Go through the motions of granting access to the console, viewing it, and then having access
 // revoked.
 func TestViewConsole(t *testing.T) {
@@ -184,3 +353,184 @@ func TestViewConsole(t *testing.T) {
 			readsFirst, "vs.", readsSecond)
 	}
 }
+
+// Mirror TestViewConsole's revoke/reconnect flow over the WebSocket
+// transport, which needs a real listener to hijack rather than the
+// responseStreamer fake used for the plain HTTP console endpoint.
+func TestViewConsoleWS(t *testing.T) {
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	resp := doAdmin(t, srv, "PUT", "/node/somenode", `{
+		"type": "ipmi",
+		"info": {"addr": "10.0.0.3", "user": "ipmiuser", "pass": "secret"}
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("TestViewConsoleWS: setup request failed with status %d", resp.StatusCode)
+	}
+
+	getToken := func() string {
+		resp := doAdmin(t, srv, "POST", "/node/somenode/console-endpoints", "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("TestViewConsoleWS: getting token failed with status %d", resp.StatusCode)
+		}
+		var respBody TokenResp
+		if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+			t.Fatalf("TestViewConsoleWS: decoding body: %v", err)
+		}
+		textToken, err := respBody.Token.MarshalText()
+		if err != nil {
+			t.Fatalf("TestViewConsoleWS: formatting token: %v", err)
+		}
+		return string(textToken)
+	}
+
+	// The read loop runs in its own goroutine, so it reports back over a
+	// channel rather than calling t.Fatalf directly -- t isn't safe to
+	// fail from a non-test goroutine. Dialing happens here, on the test
+	// goroutine, precisely so dialConsoleWS's own t.Fatalf calls stay on
+	// the right goroutine too.
+	type readResult struct {
+		count int
+		err   error
+	}
+	results := make(chan readResult, 1)
+	firstConn := dialConsoleWS(t, srv.URL, "somenode", getToken())
+	go func() {
+		// A single binary frame isn't guaranteed to hold exactly one
+		// line: the replay ring hands back whatever history had
+		// already accumulated in one unbroken chunk, which can span
+		// several lines. Buffer across reads and split on '\n', the
+		// same way a bufio.Reader would.
+		var buf []byte
+		i := 0
+		for {
+			data, err := firstConn.ReadBinary()
+			buf = append(buf, data...)
+			for {
+				idx := bytes.IndexByte(buf, '\n')
+				if idx < 0 {
+					break
+				}
+				line := buf[:idx+1]
+				buf = buf[idx+1:]
+				expected := fmt.Sprintf("%d\n", i)
+				if string(line) != expected {
+					results <- readResult{count: i, err: fmt.Errorf(
+						"unexpected data read from console: wanted %q but got %q", expected, line)}
+					return
+				}
+				i++
+			}
+			if err == io.EOF {
+				results <- readResult{count: i}
+				return
+			}
+			if err != nil {
+				results <- readResult{count: i, err: fmt.Errorf("error reading from console: %w", err)}
+				return
+			}
+		}
+	}()
+	time.Sleep(time.Second)
+
+	resp = doAdmin(t, srv, "DELETE", "/node/somenode/token", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("TestViewConsoleWS: token revocation failed with status %d", resp.StatusCode)
+	}
+
+	conn := dialConsoleWS(t, srv.URL, "somenode", getToken())
+	data, err := conn.ReadBinary()
+	if err != nil {
+		t.Fatal("TestViewConsoleWS: error reading from console:", err)
+	}
+	firstLine := data
+	if idx := bytes.IndexByte(data, '\n'); idx >= 0 {
+		firstLine = data[:idx+1]
+	}
+	var readsSecond int
+	if _, err := fmt.Sscanf(string(firstLine), "%d\n", &readsSecond); err != nil {
+		t.Fatalf("TestViewConsoleWS: error parsing output %q from console: %v", firstLine, err)
+	}
+
+	result := <-results
+	if result.err != nil {
+		t.Fatal("TestViewConsoleWS:", result.err)
+	}
+	if result.count >= readsSecond {
+		t.Fatal("TestViewConsoleWS: first console reader read a line that was not before "+
+			"what was read by the second reader:", result.count, "vs.", readsSecond)
+	}
+}
+
+// Verify that any number of clients can attach to the same console at
+// once, each seeing a monotonically increasing sequence, and that
+// revoking the token disconnects all of them together.
+func TestConsoleMultiViewer(t *testing.T) {
+	handler := newHandler()
+
+	spec := requestSpec{
+		"PUT", "http://localhost/node/somenode", `{
+			"type": "ipmi",
+			"info": {"addr": "10.0.0.3", "user": "ipmiuser", "pass": "secret"}
+		}`,
+	}
+	req := spec.toAdminAuth()
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if status := resp.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("TestConsoleMultiViewer: setup request failed with status %d", status)
+	}
+
+	token := getConsoleToken(t, handler, "somenode")
+
+	const numViewers = 4
+	results := make(chan error, numViewers)
+	for i := 0; i < numViewers; i++ {
+		go func(i int) {
+			r := bufio.NewReader(streamConsoleReader(handler, "somenode", token))
+			last := -1
+			for {
+				line, err := r.ReadString('\n')
+				if err == io.EOF {
+					results <- nil
+					return
+				}
+				if err != nil {
+					results <- fmt.Errorf("viewer %d: error reading from console: %v", i, err)
+					return
+				}
+				var v int
+				if _, err := fmt.Sscanf(line, "%d\n", &v); err != nil {
+					results <- fmt.Errorf("viewer %d: error parsing line %q: %v", i, line, err)
+					return
+				}
+				if v <= last {
+					results <- fmt.Errorf("viewer %d: read %d out of order after %d", i, v, last)
+					return
+				}
+				last = v
+			}
+		}(i)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	req = (&requestSpec{"DELETE", "http://localhost/node/somenode/token", ""}).toAdminAuth()
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if status := resp.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("TestConsoleMultiViewer: token revocation failed with status %d", status)
+	}
+
+	for i := 0; i < numViewers; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("viewer was not disconnected after token revocation")
+		}
+	}
+}
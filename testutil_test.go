@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func init() {
+	// The test suite has no real BMCs to talk to, so every "ipmi" node
+	// is driven by a fake console source that emits an incrementing
+	// counter instead of shelling out to ipmitool.
+	newConsoleSource = func(info NodeInfo) (consoleSource, error) {
+		return &fakeConsoleSource{tick: time.Millisecond}, nil
+	}
+	newPowerController = func(info NodeInfo) (powerController, error) {
+		return &fakePowerController{}, nil
+	}
+}
+
+// requestSpec is a declarative description of an HTTP request, used to
+// build the same request with different auth for table-driven tests.
+type requestSpec struct {
+	method string
+	url    string
+	body   string
+}
+
+func (s requestSpec) toNoAuth() *http.Request {
+	return httptest.NewRequest(s.method, s.url, bytes.NewBufferString(s.body))
+}
+
+func (s requestSpec) toAdminAuth() *http.Request {
+	req := s.toNoAuth()
+	req.SetBasicAuth("", defaultAdminSecret)
+	return req
+}
+
+// responseStreamer is a minimal http.ResponseWriter that streams writes
+// directly to body as they happen, rather than buffering them the way
+// httptest.ResponseRecorder does. It's used to test long-lived,
+// streamed responses like the console endpoint.
+type responseStreamer struct {
+	header     http.Header
+	body       io.Writer
+	statusCode int
+}
+
+func (r *responseStreamer) Header() http.Header {
+	return r.header
+}
+
+func (r *responseStreamer) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *responseStreamer) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+}
+
+func (r *responseStreamer) Flush() {}
+
+// getConsoleToken requests a fresh console token for node from handler,
+// the same way an admin client hitting console-endpoints would.
+func getConsoleToken(t *testing.T, handler http.Handler, node string) string {
+	t.Helper()
+	req := (&requestSpec{"POST", "http://localhost/node/" + node + "/console-endpoints", ""}).toAdminAuth()
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	result := resp.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("getConsoleToken: getting token failed with status %d", result.StatusCode)
+	}
+	var respBody TokenResp
+	if err := json.NewDecoder(result.Body).Decode(&respBody); err != nil {
+		t.Fatalf("getConsoleToken: decoding body: %v", err)
+	}
+	textToken, err := respBody.Token.MarshalText()
+	if err != nil {
+		t.Fatalf("getConsoleToken: formatting token: %v", err)
+	}
+	return string(textToken)
+}
+
+// streamConsoleReader opens a streamed GET against node's console
+// endpoint with the given token, returning the response body as it's
+// written rather than after the handler returns.
+func streamConsoleReader(handler http.Handler, node, token string) io.ReadCloser {
+	req := httptest.NewRequest(
+		"GET",
+		"http://localhost/node/"+node+"/console?token="+token,
+		bytes.NewBuffer(nil),
+	)
+	r, w := io.Pipe()
+	respStreamer := &responseStreamer{
+		header: make(http.Header),
+		body:   w,
+	}
+	go func() {
+		handler.ServeHTTP(respStreamer, req)
+		w.Close()
+	}()
+	return r
+}
+
+// dialConsoleWS performs a client-side WebSocket handshake against
+// srvURL's console/ws endpoint for node, reusing wsConn for the client
+// side of the connection since readFrame accepts the server's unmasked
+// frames as well as masked ones. wsConn does not mask the frames it
+// writes, so frames sent through it are not RFC 6455 client frames.
+// It's only usable against a real listener (e.g.
+// httptest.NewServer), since the handshake needs a real net.Conn to
+// hijack -- unlike streamConsoleReader's plain HTTP GET, it can't be
+// driven through responseStreamer.
+func dialConsoleWS(t *testing.T, srvURL, node, token string) *wsConn {
+	t.Helper()
+	u, err := url.Parse(srvURL)
+	if err != nil {
+		t.Fatalf("dialConsoleWS: parsing server URL: %v", err)
+	}
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatalf("dialConsoleWS: dialing %s: %v", u.Host, err)
+	}
+	req := "GET /node/" + node + "/console/ws?token=" + token + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatalf("dialConsoleWS: sending handshake: %v", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("dialConsoleWS: reading handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("dialConsoleWS: expected 101 Switching Protocols, got %d", resp.StatusCode)
+	}
+	return &wsConn{conn: conn, br: br}
+}
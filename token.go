@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// resourceAccess mirrors the "access" entries of a Docker/OCI distribution
+// bearer token: it grants a set of actions on a single named resource.
+type resourceAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// tokenClaims is the payload obmd signs and hands back from /token.
+type tokenClaims struct {
+	Iss    string           `json:"iss"`
+	Aud    string           `json:"aud"`
+	Exp    int64            `json:"exp"`
+	Access []resourceAccess `json:"access"`
+	Gen    map[string]int64 `json:"gen,omitempty"` // per-node console generation, for revocation
+}
+
+// allows reports whether the claims grant action on the named node.
+func (c tokenClaims) allows(nodeName, action string) bool {
+	for _, a := range c.Access {
+		if a.Type != "node" || a.Name != nodeName {
+			continue
+		}
+		for _, have := range a.Actions {
+			if have == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Token is a signed bearer token. It marshals to/from its compact text
+// form, so it can be embedded directly in JSON responses and query
+// parameters without the caller needing to know about signing.
+type Token struct {
+	raw string
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t Token) MarshalText() ([]byte, error) {
+	return []byte(t.raw), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It stores the token
+// text verbatim; verification happens later, when the token is presented
+// back to the server, via parseToken.
+func (t *Token) UnmarshalText(text []byte) error {
+	t.raw = string(text)
+	return nil
+}
+
+func (t Token) String() string {
+	return t.raw
+}
+
+// signToken signs claims with key, producing a compact
+// base64url(payload) + "." + base64url(hmac-sha256) token.
+func signToken(key []byte, claims tokenClaims) (Token, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return Token{}, fmt.Errorf("marshaling token claims: %w", err)
+	}
+	encPayload := base64.RawURLEncoding.EncodeToString(payload)
+	sig := signPayload(key, encPayload)
+	return Token{raw: encPayload + "." + sig}, nil
+}
+
+func signPayload(key []byte, encPayload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encPayload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseToken verifies tok's signature against key and decodes its claims.
+func parseToken(tok string, key []byte) (tokenClaims, error) {
+	parts := strings.SplitN(tok, ".", 2)
+	if len(parts) != 2 {
+		return tokenClaims{}, fmt.Errorf("malformed token")
+	}
+	encPayload, sig := parts[0], parts[1]
+	wantSig := signPayload(key, encPayload)
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(wantSig)) != 1 {
+		return tokenClaims{}, fmt.Errorf("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return tokenClaims{}, fmt.Errorf("decoding token payload: %w", err)
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return tokenClaims{}, fmt.Errorf("unmarshaling token claims: %w", err)
+	}
+	if time.Now().Unix() >= claims.Exp {
+		return tokenClaims{}, fmt.Errorf("token expired")
+	}
+	return claims, nil
+}
+
+// TokenResp is the JSON body returned by /token and by the
+// console-endpoints admin request. ConsoleURL and ConsoleWSURL are only
+// populated by console-endpoints, which mints a token and hands back
+// ready-to-use URLs for both console transports in one response.
+type TokenResp struct {
+	Token        Token  `json:"token"`
+	ConsoleURL   string `json:"console_url,omitempty"`
+	ConsoleWSURL string `json:"console_ws_url,omitempty"`
+}
+
+// scope is a parsed "resource-type:resource-name:action(,action)*" scope
+// parameter, as used both in the /token query string and in the
+// WWW-Authenticate challenge we emit.
+type scope struct {
+	resourceType string
+	resourceName string
+	actions      []string
+}
+
+func (s scope) String() string {
+	return fmt.Sprintf("%s:%s:%s", s.resourceType, s.resourceName, strings.Join(s.actions, ","))
+}
+
+// parseScope parses a single scope parameter value.
+func parseScope(s string) (scope, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return scope{}, fmt.Errorf("malformed scope %q", s)
+	}
+	actions := strings.Split(parts[2], ",")
+	for _, a := range actions {
+		if a == "" {
+			return scope{}, fmt.Errorf("malformed scope %q: empty action", s)
+		}
+	}
+	return scope{resourceType: parts[0], resourceName: parts[1], actions: actions}, nil
+}
+
+// wwwAuthenticate formats a Bearer WWW-Authenticate challenge for the
+// given scopes, per RFC 6750/7235 and the Docker distribution token
+// grammar.
+func wwwAuthenticate(realm, service string, scopes []scope) string {
+	var b strings.Builder
+	b.WriteString("Bearer ")
+	fmt.Fprintf(&b, "realm=%q,service=%q", realm, service)
+	for _, sc := range scopes {
+		fmt.Fprintf(&b, `,scope="%s"`, sc.String())
+	}
+	return b.String()
+}
+
+// parseAuthHeader splits a challenge header of the form
+//
+//	Scheme key1="value1",key2=value2
+//
+// into its scheme and parameters. It is structured after the
+// docker/distribution registry client's challenge parser, since obmd's
+// challenge grammar is deliberately compatible with it.
+func parseAuthHeader(header string) (scheme string, params map[string]string, err error) {
+	header = strings.TrimSpace(header)
+	sp := strings.IndexByte(header, ' ')
+	if sp < 0 {
+		return "", nil, fmt.Errorf("malformed WWW-Authenticate header: %q", header)
+	}
+	scheme = header[:sp]
+	params, err = parseValueAndParams(header[sp+1:])
+	if err != nil {
+		return "", nil, err
+	}
+	return scheme, params, nil
+}
+
+// parseValueAndParams parses a comma-separated list of key="quoted value"
+// or key=token pairs, honoring backslash escapes inside quoted strings.
+func parseValueAndParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			break
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("malformed parameter list: %q", s)
+		}
+		key := strings.TrimSpace(s[:eq])
+		rest := s[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			rest = rest[1:]
+			var b strings.Builder
+			i := 0
+			closed := false
+			for i < len(rest) {
+				c := rest[i]
+				if c == '\\' && i+1 < len(rest) {
+					b.WriteByte(rest[i+1])
+					i += 2
+					continue
+				}
+				if c == '"' {
+					closed = true
+					i++
+					break
+				}
+				b.WriteByte(c)
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("unterminated quoted string in %q", s)
+			}
+			value = b.String()
+			rest = rest[i:]
+		} else {
+			comma := strings.IndexByte(rest, ',')
+			if comma < 0 {
+				value = rest
+				rest = ""
+			} else {
+				value = rest[:comma]
+				rest = rest[comma:]
+			}
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+		s = rest
+	}
+	return params, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// serveToken implements GET /token: it authenticates the caller via
+// HTTP Basic auth (either the admin secret or a CredentialStore-backed
+// user) and mints a bearer token scoped to the intersection of the
+// requested scopes and whatever actions the caller is actually granted.
+func (h *handler) serveToken(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+h.cfg.BaseURL+`/token"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	isAdmin := h.checkAdminSecret(pass)
+	var granted []string
+	if !isAdmin {
+		granted, ok = h.cfg.Creds.Authenticate(user, pass)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	service := r.URL.Query().Get("service")
+	if service == "" {
+		service = h.cfg.Service
+	}
+
+	reqScopes := r.URL.Query()["scope"]
+	access := make([]resourceAccess, 0, len(reqScopes))
+	gens := make(map[string]int64)
+	for _, s := range reqScopes {
+		sc, err := parseScope(s)
+		if err != nil {
+			http.Error(w, "bad scope: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		actions := sc.actions
+		if !isAdmin {
+			actions = intersectActions(actions, granted)
+		}
+		if len(actions) == 0 {
+			continue
+		}
+		access = append(access, resourceAccess{Type: sc.resourceType, Name: sc.resourceName, Actions: actions})
+		if sc.resourceType == "node" {
+			if n, ok := h.nodes.get(sc.resourceName); ok {
+				if console := n.getConsole(); console != nil {
+					gens[sc.resourceName] = console.generation()
+				}
+			}
+		}
+	}
+
+	claims := tokenClaims{
+		Iss:    h.cfg.BaseURL,
+		Aud:    service,
+		Exp:    time.Now().Add(h.cfg.TokenTTL).Unix(),
+		Access: access,
+		Gen:    gens,
+	}
+	tok, err := signToken(h.cfg.SigningKey, claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenResp{Token: tok})
+}
+
+// intersectActions returns the actions present in both requested and
+// granted.
+func intersectActions(requested, granted []string) []string {
+	grantedSet := make(map[string]bool, len(granted))
+	for _, a := range granted {
+		grantedSet[a] = true
+	}
+	var out []string
+	for _, a := range requested {
+		if grantedSet[a] {
+			out = append(out, a)
+		}
+	}
+	return out
+}
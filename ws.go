@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// wsGUID is the fixed key RFC 6455 has servers append to a client's
+// Sec-WebSocket-Key before hashing, to prove the handshake was actually
+// understood as a WebSocket upgrade.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Close codes the console transport uses; see RFC 6455 section 7.4 for
+// the reserved ranges these are drawn from.
+const (
+	wsCodeTokenRevoked  = 4001
+	wsCodeInternalError = 1011
+)
+
+// maxFrameSize bounds how large a single frame's payload we'll allocate
+// for. Console traffic in both directions -- keystrokes in, SOL output
+// out -- comes in small chunks, so this is generous headroom, not a
+// tight fit; it exists to stop a client from claiming a payload length
+// near 2^63 and OOMing the process before we've even read it.
+const maxFrameSize = 1 << 20 // 1 MiB
+
+type wsOpcode byte
+
+const (
+	wsOpText   wsOpcode = 0x1
+	wsOpBinary wsOpcode = 0x2
+	wsOpClose  wsOpcode = 0x8
+	wsOpPing   wsOpcode = 0x9
+	wsOpPong   wsOpcode = 0xA
+)
+
+// wsConn is a hijacked HTTP connection upgraded to the WebSocket
+// protocol: just enough of RFC 6455 to carry the console's binary
+// frames in both directions.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// upgradeWebSocket completes the WebSocket handshake on w/r, taking over
+// the underlying TCP connection. The caller must not use w after this
+// returns successfully.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("not a websocket upgrade request")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(resp); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: rw.Reader}, nil
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// WriteBinary sends p as a single unmasked binary frame; servers never
+// mask their frames per RFC 6455.
+func (c *wsConn) WriteBinary(p []byte) error {
+	return c.writeFrame(wsOpBinary, p)
+}
+
+// Close sends a close frame carrying code and reason, then closes the
+// underlying connection.
+func (c *wsConn) Close(code uint16, reason string) error {
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	copy(payload[2:], reason)
+	err := c.writeFrame(wsOpClose, payload)
+	c.conn.Close()
+	return err
+}
+
+func (c *wsConn) writeFrame(op wsOpcode, payload []byte) error {
+	header := []byte{0x80 | byte(op)} // FIN + opcode, no more fragments
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		var ext [2]byte
+		binary.BigEndian.PutUint16(ext[:], uint16(len(payload)))
+		header = append(header, 126)
+		header = append(header, ext[:]...)
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(len(payload)))
+		header = append(header, 127)
+		header = append(header, ext[:]...)
+	}
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+// ReadBinary blocks for the next client-to-server data frame and
+// returns its (unmasked) payload. Ping frames are answered
+// transparently; a close frame surfaces as io.EOF.
+func (c *wsConn) ReadBinary() ([]byte, error) {
+	for {
+		op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpBinary, wsOpText:
+			return payload, nil
+		case wsOpClose:
+			return nil, io.EOF
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+		case wsOpPong:
+			// nothing to do
+		default:
+			return nil, fmt.Errorf("unsupported websocket opcode %#x", op)
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (wsOpcode, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return 0, nil, err
+	}
+	op := wsOpcode(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if length > maxFrameSize {
+		return 0, nil, fmt.Errorf("websocket frame too large: %d bytes", length)
+	}
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, maskKey[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+	return op, payload, nil
+}